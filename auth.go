@@ -0,0 +1,320 @@
+package caddyvault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/hashicorp/vault/api"
+	vaultapprole "github.com/hashicorp/vault/api/auth/approle"
+	vaultaws "github.com/hashicorp/vault/api/auth/aws"
+	vaultkubernetes "github.com/hashicorp/vault/api/auth/kubernetes"
+)
+
+const (
+	authMethodToken      = "token"
+	authMethodAppRole    = "approle"
+	authMethodKubernetes = "kubernetes"
+	authMethodAWS        = "aws"
+	authMethodJWT        = "jwt"
+	authMethodOIDC       = "oidc"
+
+	defaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// AuthConfig describes how VaultStorage should authenticate against the Vault
+// server. Method selects one of "token" (the default), "approle",
+// "kubernetes", "aws" or "jwt"/"oidc"; the remaining fields are only
+// consulted by the method they belong to.
+type AuthConfig struct {
+	Method string
+
+	// Token auth. Falls back to the VAULT_TOKEN env variable.
+	Token string
+
+	// AppRole auth. RoleID/SecretID can instead be read from a file, which is
+	// handy for a secret_id dropped on disk by a CI pipeline. The file's
+	// contents are used as the secret_id itself; a response-wrapped
+	// secret_id is not unwrapped.
+	RoleID       string
+	RoleIDFile   string
+	SecretID     string
+	SecretIDFile string
+
+	// MountPath overrides the default mount path of the selected auth
+	// method, e.g. "approle-prod" for a backend mounted at auth/approle-prod.
+	MountPath string
+
+	// Role is the Vault role to request. Used by "kubernetes", "aws" and
+	// "jwt"/"oidc".
+	Role string
+
+	// ServiceAccountTokenFile is read for the "kubernetes" method. Defaults
+	// to the in-cluster projected service account token.
+	ServiceAccountTokenFile string
+
+	// JWT auth / OIDC. JWT is read verbatim if set, otherwise JWTFile is read.
+	JWT     string
+	JWTFile string
+}
+
+// login authenticates vs.client using the configured Auth method and, for
+// every method other than "token" whose login returns a renewable token,
+// starts a background renewer that keeps the resulting lease alive for as
+// long as vs is in use.
+func (vs *VaultStorage) login(ctx context.Context) error {
+	method := vs.Auth.Method
+	if method == "" {
+		method = authMethodToken
+	}
+
+	switch method {
+	case authMethodToken:
+		return vs.loginToken()
+	case authMethodAppRole:
+		authMethod, err := vs.appRoleAuthMethod()
+		return vs.loginWith(ctx, authMethod, err)
+	case authMethodKubernetes:
+		authMethod, err := vs.kubernetesAuthMethod()
+		return vs.loginWith(ctx, authMethod, err)
+	case authMethodAWS:
+		authMethod, err := vs.awsAuthMethod()
+		return vs.loginWith(ctx, authMethod, err)
+	case authMethodJWT, authMethodOIDC:
+		return vs.loginJWT(ctx, method)
+	default:
+		return fmt.Errorf("caddyvault: unsupported auth method %q", method)
+	}
+}
+
+func (vs *VaultStorage) loginToken() error {
+	token := vs.Auth.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		return fmt.Errorf("caddyvault: unable to find Vault token; set it in the Caddyfile or VAULT_TOKEN")
+	}
+	vs.client.SetToken(token)
+	return nil
+}
+
+// vaultAuthMethod is an alias for api.AuthMethod, the type returned by the
+// approle/kubernetes/aws helpers below and passed to loginWith, whichever
+// one was used.
+type vaultAuthMethod = api.AuthMethod
+
+func (vs *VaultStorage) appRoleAuthMethod() (vaultAuthMethod, error) {
+	roleID, err := resolveCredential(vs.Auth.RoleID, vs.Auth.RoleIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("caddyvault: reading approle role_id: %w", err)
+	}
+	if roleID == "" {
+		return nil, fmt.Errorf("caddyvault: approle auth requires role_id or role_id_file")
+	}
+
+	secretID := &vaultapprole.SecretID{FromString: vs.Auth.SecretID}
+	if vs.Auth.SecretID == "" && vs.Auth.SecretIDFile != "" {
+		secretID = &vaultapprole.SecretID{FromFile: vs.Auth.SecretIDFile}
+	}
+
+	opts := []vaultapprole.LoginOption{}
+	if vs.Auth.MountPath != "" {
+		opts = append(opts, vaultapprole.WithMountPath(vs.Auth.MountPath))
+	}
+	return vaultapprole.NewAppRoleAuth(roleID, secretID, opts...)
+}
+
+func (vs *VaultStorage) kubernetesAuthMethod() (vaultAuthMethod, error) {
+	if vs.Auth.Role == "" {
+		return nil, fmt.Errorf("caddyvault: kubernetes auth requires a role")
+	}
+
+	tokenFile := vs.Auth.ServiceAccountTokenFile
+	if tokenFile == "" {
+		tokenFile = defaultServiceAccountTokenFile
+	}
+
+	opts := []vaultkubernetes.LoginOption{vaultkubernetes.WithServiceAccountTokenPath(tokenFile)}
+	if vs.Auth.MountPath != "" {
+		opts = append(opts, vaultkubernetes.WithMountPath(vs.Auth.MountPath))
+	}
+	return vaultkubernetes.NewKubernetesAuth(vs.Auth.Role, opts...)
+}
+
+func (vs *VaultStorage) awsAuthMethod() (vaultAuthMethod, error) {
+	if vs.Auth.Role == "" {
+		return nil, fmt.Errorf("caddyvault: aws auth requires a role")
+	}
+
+	opts := []vaultaws.LoginOption{vaultaws.WithRole(vs.Auth.Role), vaultaws.WithIAMAuth()}
+	if vs.Auth.MountPath != "" {
+		opts = append(opts, vaultaws.WithMountPath(vs.Auth.MountPath))
+	}
+	return vaultaws.NewAWSAuth(opts...)
+}
+
+func (vs *VaultStorage) loginJWT(ctx context.Context, method string) error {
+	jwt, err := resolveCredential(vs.Auth.JWT, vs.Auth.JWTFile)
+	if err != nil {
+		return fmt.Errorf("caddyvault: reading jwt: %w", err)
+	}
+	if jwt == "" {
+		return fmt.Errorf("caddyvault: jwt/oidc auth requires jwt or jwt_file")
+	}
+	if vs.Auth.Role == "" {
+		return fmt.Errorf("caddyvault: jwt/oidc auth requires a role")
+	}
+
+	// MountPath is the bare mount name, same as approle/kubernetes/aws
+	// (e.g. "jwt-prod" for a backend mounted at auth/jwt-prod), defaulting
+	// to the method name itself so "oidc" doesn't log in against "auth/jwt".
+	mount := vs.Auth.MountPath
+	if mount == "" {
+		mount = method
+	}
+
+	secret, err := vs.client.Logical().WriteWithContext(ctx, "auth/"+mount+"/login", map[string]interface{}{
+		"role": vs.Auth.Role,
+		"jwt":  jwt,
+	})
+	if err != nil {
+		return fmt.Errorf("caddyvault: jwt login: %w", err)
+	}
+	return vs.watchRenewal(secret)
+}
+
+// loginWith performs a Login against client with the given auth method and,
+// on success, hands the returned secret to the lifetime watcher so the lease
+// is renewed automatically.
+func (vs *VaultStorage) loginWith(ctx context.Context, method vaultAuthMethod, err error) error {
+	if err != nil {
+		return err
+	}
+	secret, err := vs.client.Auth().Login(ctx, method)
+	if err != nil {
+		return fmt.Errorf("caddyvault: vault login: %w", err)
+	}
+	return vs.watchRenewal(secret)
+}
+
+// watchRenewal starts a LifetimeWatcher for secret and spawns a goroutine
+// that keeps vs.client's token alive for as long as the watcher runs. The
+// watcher stops, and the token is left to expire, once Cleanup is called.
+func (vs *VaultStorage) watchRenewal(secret *api.Secret) error {
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("caddyvault: login returned no auth info")
+	}
+	if !secret.Auth.Renewable {
+		return nil
+	}
+
+	watcher, err := vs.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		return fmt.Errorf("caddyvault: creating lifetime watcher: %w", err)
+	}
+
+	go watcher.Start()
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case <-vs.closeCh:
+				return
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					// The lease could not be renewed; nothing left to do but
+					// let the next Vault call fail and surface the problem.
+					return
+				}
+				return
+			case <-watcher.RenewCh():
+				// token renewed in place, nothing to do
+			}
+		}
+	}()
+	return nil
+}
+
+// resolveCredential returns value if set, otherwise the trimmed contents of
+// file if it is non-empty.
+func resolveCredential(value, file string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// unmarshalAuthCaddyfile parses an "auth <method> { ... }" directive into
+// vs.Auth. It is called from VaultStorage.UnmarshalCaddyfile with the
+// dispenser positioned on the "auth" token.
+func (vs *VaultStorage) unmarshalAuthCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	method := d.Val()
+
+	switch method {
+	case authMethodToken, authMethodAppRole, authMethodKubernetes, authMethodAWS, authMethodJWT, authMethodOIDC:
+		vs.Auth.Method = method
+	default:
+		return d.Errf("unrecognized auth method: %s", method)
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "token":
+			if d.NextArg() {
+				vs.Auth.Token = d.Val()
+			}
+		case "role_id":
+			if d.NextArg() {
+				vs.Auth.RoleID = d.Val()
+			}
+		case "role_id_file":
+			if d.NextArg() {
+				vs.Auth.RoleIDFile = d.Val()
+			}
+		case "secret_id":
+			if d.NextArg() {
+				vs.Auth.SecretID = d.Val()
+			}
+		case "secret_id_file":
+			if d.NextArg() {
+				vs.Auth.SecretIDFile = d.Val()
+			}
+		case "role":
+			if d.NextArg() {
+				vs.Auth.Role = d.Val()
+			}
+		case "jwt":
+			if d.NextArg() {
+				vs.Auth.JWT = d.Val()
+			}
+		case "jwt_file":
+			if d.NextArg() {
+				vs.Auth.JWTFile = d.Val()
+			}
+		case "service_account_token_file":
+			if d.NextArg() {
+				vs.Auth.ServiceAccountTokenFile = d.Val()
+			}
+		case "mount_path":
+			if d.NextArg() {
+				vs.Auth.MountPath = d.Val()
+			}
+		default:
+			return d.Errf("unrecognized auth subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package caddyvault
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+var (
+	// ErrVaultUnavailable indicates the request could not reach a healthy
+	// Vault: a network failure, a 429, a 500, or a 503 that isn't sealed.
+	ErrVaultUnavailable = errors.New("caddyvault: vault unavailable")
+	// ErrPermissionDenied indicates Vault rejected the request's token or policy.
+	ErrPermissionDenied = errors.New("caddyvault: permission denied")
+	// ErrSealed indicates Vault is sealed and cannot serve the request.
+	ErrSealed = errors.New("caddyvault: vault is sealed")
+)
+
+// classifyError maps a raw error from the Vault client onto one of this
+// package's typed sentinels, so certmagic's retry logic can tell a
+// transient outage apart from a permanent denial instead of seeing every
+// failure as a missing key. Genuine 404s are left to the caller, which
+// already treats a nil secret as os.ErrNotExist.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) {
+		// Transport-level failure: DNS, connection refused, context deadline...
+		return fmt.Errorf("%w: %v", ErrVaultUnavailable, err)
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, respErr)
+	case http.StatusServiceUnavailable:
+		if isSealedError(respErr) {
+			return fmt.Errorf("%w: %v", ErrSealed, respErr)
+		}
+		return fmt.Errorf("%w: %v", ErrVaultUnavailable, respErr)
+	case http.StatusTooManyRequests, http.StatusInternalServerError:
+		return fmt.Errorf("%w: %v", ErrVaultUnavailable, respErr)
+	default:
+		return err
+	}
+}
+
+// isSealedError reports whether respErr's error list is Vault's well-known
+// "Vault is sealed" message.
+func isSealedError(respErr *api.ResponseError) bool {
+	for _, e := range respErr.Errors {
+		if strings.Contains(strings.ToLower(e), "sealed") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package caddyvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadErrorMapping(t *testing.T) {
+	cases := []struct {
+		name       string
+		statusCode int
+		body       string
+		wantErr    error // checked with errors.Is
+	}{
+		{name: "not found", statusCode: http.StatusNotFound, body: `{"errors":[]}`, wantErr: os.ErrNotExist},
+		{name: "permission denied", statusCode: http.StatusForbidden, body: `{"errors":["permission denied"]}`, wantErr: ErrPermissionDenied},
+		{name: "rate limited", statusCode: http.StatusTooManyRequests, body: `{"errors":["rate limit exceeded"]}`, wantErr: ErrVaultUnavailable},
+		{name: "internal error", statusCode: http.StatusInternalServerError, body: `{"errors":["internal error"]}`, wantErr: ErrVaultUnavailable},
+		{name: "sealed", statusCode: http.StatusServiceUnavailable, body: `{"errors":["Vault is sealed"]}`, wantErr: ErrSealed},
+		{name: "unavailable, not sealed", statusCode: http.StatusServiceUnavailable, body: `{"errors":["upstream connection error"]}`, wantErr: ErrVaultUnavailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCode)
+				_, _ = fmt.Fprint(w, tc.body)
+			}))
+			t.Cleanup(srv.Close)
+
+			vs := &VaultStorage{
+				API:  srv.URL,
+				Auth: AuthConfig{Method: authMethodToken, Token: "test-token"},
+			}
+			if err := vs.Provision(testCaddyContext(t)); err != nil {
+				t.Fatalf("Provision() error = %v", err)
+			}
+
+			_, err := vs.Load(context.Background(), "some-cert")
+			if err == nil {
+				t.Fatalf("Load() error = nil, want %v", tc.wantErr)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Load() error = %v, want it to wrap %v", err, tc.wantErr)
+			}
+		})
+	}
+}
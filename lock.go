@@ -0,0 +1,274 @@
+package caddyvault
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	lockSuffix = ".lock"
+
+	// lockTTL is how long a lock may be held before another instance is
+	// allowed to reclaim it as stale. The owning instance renews well before
+	// this via startLockRefresher.
+	lockTTL        = 60 * time.Second
+	lockRefreshDiv = 3
+
+	lockBackoffMin = 250 * time.Millisecond
+	lockBackoffMax = 5 * time.Second
+)
+
+// lockValue is the JSON payload stored at a lock's sentinel key. Expiry lets
+// a stale lock be detected by its content rather than Vault's created_time
+// metadata, and Owner identifies the instance holding the lock so Unlock can
+// refuse to release a lock that was reclaimed by someone else after expiry.
+type lockValue struct {
+	Owner  string    `json:"owner"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// Lock blocks until it acquires the lock on key or ctx is done, using a
+// check-and-set write so only one caller can ever claim it. While held, a
+// background refresher bumps the lock's expiry at ~1/3 of its TTL.
+func (vs *VaultStorage) Lock(ctx context.Context, key string) error {
+	lockKey := key + lockSuffix
+	backoff := lockBackoffMin
+
+	for {
+		version, acquired, err := vs.tryAcquireLock(ctx, lockKey)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			vs.startLockRefresher(ctx, lockKey, version)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		if backoff *= 2; backoff > lockBackoffMax {
+			backoff = lockBackoffMax
+		}
+	}
+}
+
+// tryAcquireLock makes a single attempt at claiming lockKey: first assuming
+// it is absent (cas=0), then, if it is present but expired, reclaiming it
+// with the version it last observed. On success it returns the KV v2
+// version of the write, which startLockRefresher uses as the CAS baseline
+// for its first renewal.
+func (vs *VaultStorage) tryAcquireLock(ctx context.Context, lockKey string) (int, bool, error) {
+	payload, err := json.Marshal(lockValue{Owner: vs.instanceID, Expiry: time.Now().Add(lockTTL)})
+	if err != nil {
+		return 0, false, err
+	}
+
+	if version, ok, err := vs.casWriteLock(ctx, lockKey, payload, 0); err != nil || ok {
+		return version, ok, err
+	}
+
+	rctx, cancel := vs.withTimeout(ctx)
+	secret, err := vs.client.Logical().ReadWithContext(rctx, vs.buildPath(dataURL, lockKey))
+	cancel()
+	if err != nil {
+		return 0, false, err
+	}
+	if secret == nil {
+		// Raced with a concurrent Unlock; retry on the next loop iteration.
+		return 0, false, nil
+	}
+
+	raw, _ := secretData(secret)[lockKey].(string)
+	var existing lockValue
+	if err := json.Unmarshal([]byte(raw), &existing); err == nil && time.Now().Before(existing.Expiry) {
+		return 0, false, nil
+	}
+
+	return vs.casWriteLock(ctx, lockKey, payload, secretVersion(secret))
+}
+
+// casWriteLock attempts to write payload to lockKey's data, conditioned on
+// cas matching the key's current KV v2 version. It returns (_, false, nil)
+// on a CAS mismatch so the caller can retry or back off, and a non-nil error
+// only for genuine Vault failures. On success it returns the new version.
+func (vs *VaultStorage) casWriteLock(ctx context.Context, lockKey string, payload []byte, cas int) (int, bool, error) {
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	secret, err := vs.client.Logical().WriteWithContext(rctx, vs.buildPath(dataURL, lockKey), map[string]interface{}{
+		"options": map[string]interface{}{"cas": cas},
+		"data":    map[string]interface{}{lockKey: string(payload)},
+	})
+	if err == nil {
+		return writeVersion(secret), true, nil
+	}
+	if isCASMismatch(err) {
+		return 0, false, nil
+	}
+	return 0, false, err
+}
+
+// startLockRefresher spawns a goroutine that keeps lockKey's expiry in the
+// future, CAS-writing off the version it last wrote so a refresh delayed
+// past lockTTL can never clobber another instance's reclaim of an expired
+// lock: the write loses the race and the refresher stops instead. It exits
+// when Unlock/Cleanup stop it, when ctx (the context passed to the Lock call
+// that acquired it) is done, or once it loses ownership of the lock.
+func (vs *VaultStorage) startLockRefresher(ctx context.Context, lockKey string, version int) {
+	stop := make(chan struct{})
+	vs.refreshers.Store(lockKey, stop)
+
+	go func() {
+		ticker := time.NewTicker(lockTTL / lockRefreshDiv)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-vs.closeCh:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				payload, err := json.Marshal(lockValue{Owner: vs.instanceID, Expiry: time.Now().Add(lockTTL)})
+				if err != nil {
+					continue
+				}
+				newVersion, ok, err := vs.casWriteLock(context.Background(), lockKey, payload, version)
+				if err != nil {
+					continue
+				}
+				if !ok {
+					// Another instance reclaimed this lock after it expired;
+					// it owns it now, so stop renewing it.
+					return
+				}
+				version = newVersion
+			}
+		}
+	}()
+}
+
+func (vs *VaultStorage) stopLockRefresher(lockKey string) {
+	if stop, ok := vs.refreshers.LoadAndDelete(lockKey); ok {
+		close(stop.(chan struct{}))
+	}
+}
+
+// Unlock releases the lock on key. It refuses to do so if the stored lock is
+// no longer owned by this instance, e.g. because it expired and was
+// reclaimed by another one in the meantime. The release itself is a
+// compare-and-delete keyed on the version observed above, so a lock
+// reclaimed by another instance between that read and the delete below is
+// never torn down out from under its new owner. The refresher is stopped
+// first, before that read, so its periodic renewal can't bump the version
+// out from under the CAS delete and leave the lock lingering until its TTL
+// expires.
+func (vs *VaultStorage) Unlock(ctx context.Context, key string) error {
+	lockKey := key
+	if !strings.HasSuffix(lockKey, lockSuffix) {
+		lockKey += lockSuffix
+	}
+	vs.stopLockRefresher(lockKey)
+
+	rctx, cancel := vs.withTimeout(ctx)
+	secret, err := vs.client.Logical().ReadWithContext(rctx, vs.buildPath(dataURL, lockKey))
+	cancel()
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return nil
+	}
+
+	raw, _ := secretData(secret)[lockKey].(string)
+	var existing lockValue
+	if err := json.Unmarshal([]byte(raw), &existing); err == nil && existing.Owner != vs.instanceID {
+		return fmt.Errorf("caddyvault: refusing to unlock %q: held by another instance", key)
+	}
+
+	return vs.casDeleteLock(ctx, lockKey, secretVersion(secret))
+}
+
+// casDeleteLock permanently removes lockKey, but only after proving via a
+// CAS write that its version still matches the one Unlock observed. If the
+// CAS write loses the race, another instance has already reclaimed or
+// released the lock since, so the metadata delete is skipped entirely
+// rather than risk deleting that instance's lock.
+func (vs *VaultStorage) casDeleteLock(ctx context.Context, lockKey string, version int) error {
+	released, err := json.Marshal(lockValue{Owner: vs.instanceID})
+	if err != nil {
+		return err
+	}
+	if _, ok, err := vs.casWriteLock(ctx, lockKey, released, version); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	_, err = vs.client.Logical().DeleteWithContext(rctx, vs.buildPath(metaURL, lockKey))
+	return err
+}
+
+// secretVersion extracts the KV v2 metadata version of secret, or 0.
+func secretVersion(secret *api.Secret) int {
+	if secret == nil {
+		return 0
+	}
+	meta, _ := secret.Data["metadata"].(map[string]interface{})
+	if v, ok := meta["version"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// writeVersion extracts the KV v2 version returned by a data write, whose
+// response shape (version at the top level of Data) differs from a read's
+// (nested under "metadata").
+func writeVersion(secret *api.Secret) int {
+	if secret == nil {
+		return 0
+	}
+	if v, ok := secret.Data["version"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// isCASMismatch reports whether err is a Vault 400 response, which is how
+// the KV v2 engine signals that a check-and-set write lost the race.
+func isCASMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusBadRequest
+	}
+	return false
+}
+
+// jitter returns a duration in [d/2, 3d/2), so concurrent lock waiters don't
+// retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// newInstanceID returns a random identifier used to mark locks this instance
+// acquires, so Unlock can tell them apart from another instance's.
+func newInstanceID() string {
+	b := make([]byte, 16)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,39 @@
+package caddyvault
+
+import "github.com/hashicorp/vault/api"
+
+// TLSConfig configures the TLS connection used to reach the Vault server,
+// including mTLS client authentication. Any field left empty falls back to
+// the corresponding VAULT_* environment variable already honored by the
+// Vault SDK (VAULT_CACERT, VAULT_CAPATH, VAULT_CLIENT_CERT, VAULT_CLIENT_KEY,
+// VAULT_TLS_SERVER_NAME, VAULT_SKIP_VERIFY).
+type TLSConfig struct {
+	// CACert is the path to a PEM-encoded CA certificate file used to verify the Vault server.
+	CACert string
+	// CAPath is a directory of PEM-encoded CA certificate files, as an alternative to CACert.
+	CAPath string
+	// ClientCert / ClientKey are the PEM-encoded client certificate and key used for mTLS.
+	ClientCert string
+	ClientKey  string
+	// ServerName overrides the server name used to verify the Vault server's certificate.
+	ServerName string
+	// SkipVerify disables verification of the Vault server's certificate. Not recommended.
+	SkipVerify bool
+}
+
+// apiTLSConfig converts tc to an *api.TLSConfig for api.Config.ConfigureTLS,
+// or nil if nothing was set, so that env-derived TLS settings already
+// applied by api.DefaultConfig are left untouched.
+func (tc TLSConfig) apiTLSConfig() *api.TLSConfig {
+	if tc == (TLSConfig{}) {
+		return nil
+	}
+	return &api.TLSConfig{
+		CACert:        tc.CACert,
+		CAPath:        tc.CAPath,
+		ClientCert:    tc.ClientCert,
+		ClientKey:     tc.ClientKey,
+		TLSServerName: tc.ServerName,
+		Insecure:      tc.SkipVerify,
+	}
+}
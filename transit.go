@@ -0,0 +1,92 @@
+package caddyvault
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+const defaultTransitMount = "transit"
+
+// TransitConfig enables envelope encryption of stored certificate data via
+// Vault's Transit secrets engine, so that a KV read capability alone is not
+// enough to recover private key material. Key must name an existing Transit
+// key; Context is passed through for keys created with derivation enabled.
+type TransitConfig struct {
+	// Mount is the Transit engine's mount path. Defaults to "transit".
+	Mount string
+	// Key is the name of the Transit key used to encrypt/decrypt stored values.
+	Key string
+	// Context is the derivation context forwarded to Transit, for keys created with derivation enabled.
+	Context string
+}
+
+// enabled reports whether Transit envelope encryption is configured.
+func (tc TransitConfig) enabled() bool {
+	return tc.Key != ""
+}
+
+func (tc TransitConfig) mount() string {
+	if tc.Mount != "" {
+		return tc.Mount
+	}
+	return defaultTransitMount
+}
+
+// encrypt wraps plaintext via Transit, returning the "vault:v1:..." ciphertext
+// to be stored in KV. It is a no-op, returning plaintext unchanged, when
+// Transit is not configured.
+func (vs *VaultStorage) encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if !vs.Transit.enabled() {
+		return plaintext, nil
+	}
+
+	data := map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}
+	if vs.Transit.Context != "" {
+		data["context"] = base64.StdEncoding.EncodeToString([]byte(vs.Transit.Context))
+	}
+
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	path := fmt.Sprintf("%s/encrypt/%s", vs.Transit.mount(), vs.Transit.Key)
+	secret, err := vs.client.Logical().WriteWithContext(rctx, path, data)
+	if err != nil {
+		return nil, fmt.Errorf("caddyvault: transit encrypt: %w", err)
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("caddyvault: transit encrypt: response missing ciphertext")
+	}
+	return []byte(ciphertext), nil
+}
+
+// decrypt reverses encrypt. It is a no-op when Transit is not configured.
+// When Transit is configured, every stored value is sent to Transit, so a
+// plaintext value written before Transit was enabled fails to decrypt.
+func (vs *VaultStorage) decrypt(ctx context.Context, stored []byte) ([]byte, error) {
+	if !vs.Transit.enabled() {
+		return stored, nil
+	}
+
+	data := map[string]interface{}{
+		"ciphertext": string(stored),
+	}
+	if vs.Transit.Context != "" {
+		data["context"] = base64.StdEncoding.EncodeToString([]byte(vs.Transit.Context))
+	}
+
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	path := fmt.Sprintf("%s/decrypt/%s", vs.Transit.mount(), vs.Transit.Key)
+	secret, err := vs.client.Logical().WriteWithContext(rctx, path, data)
+	if err != nil {
+		return nil, fmt.Errorf("caddyvault: transit decrypt: %w", err)
+	}
+	encoded, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("caddyvault: transit decrypt: response missing plaintext")
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
@@ -2,17 +2,15 @@ package caddyvault
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
-	"github.com/pydio/caddyvault/utils"
+	"github.com/hashicorp/vault/api"
 )
 
 const (
@@ -20,6 +18,8 @@ const (
 
 	dataURL = "data"
 	metaURL = "metadata"
+
+	defaultRequestTimeout = 30 * time.Second
 )
 
 // VaultStorage is a certmagic.Storage implementation for storing for ACME certificates
@@ -29,8 +29,25 @@ type VaultStorage struct {
 	API string
 	// Prefix is the vault server store path. A secret engine **v2** must be created at this path. Defaults to 'caddycerts'.
 	Prefix string
-	// Token should generally be passed via the VAULT_TOKEN env variable, but can be set manually here.
-	Token string
+	// Auth configures how this module authenticates to Vault. Defaults to the "token" method.
+	Auth AuthConfig
+
+	// Namespace selects a Vault Enterprise namespace. Falls back to VAULT_NAMESPACE.
+	Namespace string
+
+	// TLS holds the client TLS / mTLS configuration used to reach the Vault server.
+	TLS TLSConfig
+
+	// Transit, if configured, envelope-encrypts stored certificate data via the Transit secrets engine.
+	Transit TransitConfig
+
+	// RequestTimeout bounds a single Vault request when ctx has no deadline of its own. Defaults to 30s.
+	RequestTimeout time.Duration
+
+	client     *api.Client
+	closeCh    chan struct{}
+	instanceID string
+	refreshers sync.Map
 }
 
 func (vs *VaultStorage) CaddyModule() caddy.ModuleInfo {
@@ -49,8 +66,37 @@ func init() {
 func (vs *VaultStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		key := d.Val()
-		var value string
 
+		if key == "transit" {
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "mount":
+					if d.NextArg() {
+						vs.Transit.Mount = d.Val()
+					}
+				case "key":
+					if d.NextArg() {
+						vs.Transit.Key = d.Val()
+					}
+				case "context":
+					if d.NextArg() {
+						vs.Transit.Context = d.Val()
+					}
+				default:
+					return d.Errf("unrecognized transit subdirective: %s", d.Val())
+				}
+			}
+			continue
+		}
+
+		if key == "auth" {
+			if err := vs.unmarshalAuthCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var value string
 		if !d.Args(&value) {
 			continue
 		}
@@ -66,8 +112,31 @@ func (vs *VaultStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 		case "token":
 			if value != "" {
-				utils.Token = value
+				vs.Auth.Method = authMethodToken
+				vs.Auth.Token = value
+			}
+		case "namespace":
+			if value != "" {
+				vs.Namespace = value
 			}
+		case "ca_cert":
+			vs.TLS.CACert = value
+		case "ca_path":
+			vs.TLS.CAPath = value
+		case "client_cert":
+			vs.TLS.ClientCert = value
+		case "client_key":
+			vs.TLS.ClientKey = value
+		case "tls_server_name":
+			vs.TLS.ServerName = value
+		case "tls_skip_verify":
+			vs.TLS.SkipVerify = value == "true"
+		case "request_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid request_timeout %q: %v", value, err)
+			}
+			vs.RequestTimeout = timeout
 		}
 	}
 	if vs.API == "" {
@@ -77,13 +146,50 @@ func (vs *VaultStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			return fmt.Errorf("unable to find Vault address. Make sure to define it in Caddyfile or in VAULT_ADDR env")
 		}
 	}
-	if utils.Token == "" && os.Getenv("VAULT_TOKEN") == "" {
+	if vs.Auth.Method == "" && vs.Auth.Token == "" && os.Getenv("VAULT_TOKEN") == "" {
 		return fmt.Errorf("unable to find Vault token. Make sure to define it in Caddyfile or in VAULT_TOKEN env")
 	}
 	return nil
 }
 
 func (vs *VaultStorage) Provision(ctx caddy.Context) error {
+	config := api.DefaultConfig()
+	config.Address = vs.API
+	if tlsConfig := vs.TLS.apiTLSConfig(); tlsConfig != nil {
+		if err := config.ConfigureTLS(tlsConfig); err != nil {
+			return fmt.Errorf("caddyvault: configuring TLS: %w", err)
+		}
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("caddyvault: building Vault client: %w", err)
+	}
+	vs.client = client
+	vs.closeCh = make(chan struct{})
+	vs.instanceID = newInstanceID()
+
+	namespace := vs.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if namespace != "" {
+		vs.client.SetNamespace(namespace)
+	}
+
+	return vs.login(ctx.Context)
+}
+
+// Cleanup stops any background renewal goroutines started by Provision.
+func (vs *VaultStorage) Cleanup() error {
+	vs.refreshers.Range(func(k, v interface{}) bool {
+		close(v.(chan struct{}))
+		vs.refreshers.Delete(k)
+		return true
+	})
+	if vs.closeCh != nil {
+		close(vs.closeCh)
+	}
 	return nil
 }
 
@@ -92,25 +198,43 @@ func (vs *VaultStorage) CertMagicStorage() (certmagic.Storage, error) {
 	return vs, nil
 }
 
-func (vs *VaultStorage) buildURL(u string, key ...string) string {
+// withTimeout returns ctx unchanged if it already carries a deadline,
+// otherwise a derived context bounded by RequestTimeout (or
+// defaultRequestTimeout). The returned cancel func must always be called.
+func (vs *VaultStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	timeout := vs.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (vs *VaultStorage) buildPath(u string, key ...string) string {
 	pref := vs.Prefix
 	if pref == "" {
 		pref = defaultPrefix
 	}
-	ur := vs.API + "/v1/" + pref + "/" + u + "/"
+	p := pref + "/" + u + "/"
 	if len(key) > 0 {
-		ur += key[0]
+		p += key[0]
 	}
-	return ur
+	return p
 }
 
 // List lists certificates
 func (vs *VaultStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
 	var list []string
+	var err error
 	if recursive {
-		list = listPath(vs.buildURL(metaURL), vs.buildURL(dataURL), prefix)
+		list, err = vs.listPath(ctx, vs.buildPath(metaURL), vs.buildPath(dataURL), prefix)
 	} else {
-		list = queryPath(vs.buildURL(dataURL), prefix)
+		list, err = vs.queryPath(ctx, vs.buildPath(dataURL), prefix)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if len(list) == 0 {
@@ -121,45 +245,88 @@ func (vs *VaultStorage) List(ctx context.Context, prefix string, recursive bool)
 
 // Load retrieves certificate of key
 func (vs *VaultStorage) Load(ctx context.Context, key string) ([]byte, error) {
-	res := utils.QueryStore(vs.buildURL(dataURL, key))
-	if len(res.Data.Data) == 0 {
-		return []byte{}, os.ErrNotExist
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	secret, err := vs.client.Logical().ReadWithContext(rctx, vs.buildPath(dataURL, key))
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	data := secretData(secret)
+	if len(data) == 0 {
+		return nil, os.ErrNotExist
 	}
-	return []byte(res.Data.Data[key].(string)), nil
+	value, ok := data[key].(string)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return vs.decrypt(ctx, []byte(value))
 }
 
 // Store stores certificate with key association
 func (vs *VaultStorage) Store(ctx context.Context, key string, value []byte) error {
-	data := make(map[string]string)
-	data[key] = string(value)
-	req := &utils.Request{
-		Data: data,
-	}
-	byteData, _ := json.Marshal(req)
-	response, err := utils.LoadStore(vs.buildURL(dataURL, key), byteData)
-	if len(response.Errors) > 0 {
-		return errors.New("Failed to store, error: " + response.Errors[0])
+	stored, err := vs.encrypt(ctx, value)
+	if err != nil {
+		return err
 	}
-	return err
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	_, err = vs.client.Logical().WriteWithContext(rctx, vs.buildPath(dataURL, key), map[string]interface{}{
+		"data": map[string]interface{}{
+			key: string(stored),
+		},
+	})
+	return classifyError(err)
 }
 
 // Exists returns existance of certificate with key
 func (vs *VaultStorage) Exists(ctx context.Context, key string) bool {
-	res := utils.QueryStore(vs.buildURL(dataURL, key))
-	return len(res.Data.Data) > 0 && !res.Data.Metadata.Destroyed
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	secret, err := vs.client.Logical().ReadWithContext(rctx, vs.buildPath(dataURL, key))
+	if err != nil || secret == nil {
+		return false
+	}
+	return len(secretData(secret)) > 0 && !secretDestroyed(secret)
 }
 
 // Stat retrieves status of certificate with key param
 func (vs *VaultStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	res := utils.QueryStore(vs.buildURL(dataURL, key))
-	_, err := vs.List(ctx, key, false)
-	modified, merror := time.Parse(time.RFC3339, res.Data.Metadata.CreatedTime)
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	secret, err := vs.client.Logical().ReadWithContext(rctx, vs.buildPath(dataURL, key))
+	if err != nil {
+		return certmagic.KeyInfo{}, classifyError(err)
+	}
+	if secret == nil {
+		return certmagic.KeyInfo{}, os.ErrNotExist
+	}
+
+	data := secretData(secret)
+	value, ok := data[key].(string)
+	if !ok {
+		return certmagic.KeyInfo{}, os.ErrNotExist
+	}
+	plaintext, err := vs.decrypt(ctx, []byte(value))
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+
+	modified := secretCreatedTime(secret)
+	_, err = vs.List(ctx, key, false)
 	return certmagic.KeyInfo{
 		Key:        key,
 		IsTerminal: err == os.ErrNotExist,
-		Size:       int64(len(res.Data.Data[key].(string))),
+		Size:       int64(len(plaintext)),
 		Modified:   modified,
-	}, merror
+	}, nil
+}
+
+// Delete deletes the certificate from vault.
+func (vs *VaultStorage) Delete(ctx context.Context, key string) error {
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	_, err := vs.client.Logical().DeleteWithContext(rctx, vs.buildPath(metaURL, key))
+	return classifyError(err)
 }
 
 /*
@@ -167,83 +334,90 @@ Util functions start here
 listPath and queryPath
 */
 
-func listPath(listurl, loadurl, prefix string) []string {
-	var list []string
-	var res utils.Result
+func (vs *VaultStorage) listPath(ctx context.Context, listPath, loadPath, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// list all the keys
-	list = append(list, queryPath(loadurl, prefix)...)
+	list, err := vs.queryPath(ctx, loadPath, prefix)
+	if err != nil {
+		return list, err
+	}
 
-	// list all the paths and loop keys
-	res = utils.ListStore(listurl + prefix)
-	for _, path := range res.Data.Keys {
-		list = append(list, listPath(listurl+prefix, loadurl+prefix, "/"+path)...)
+	rctx, cancel := vs.withTimeout(ctx)
+	secret, err := vs.client.Logical().ListWithContext(rctx, listPath+prefix)
+	cancel()
+	if err != nil {
+		return list, classifyError(err)
+	}
+	if secret == nil {
+		return list, nil
 	}
-	return list
-}
 
-func queryPath(url, prefix string) []string {
-	var res utils.Result
-	var list []string
-	res = utils.QueryStore(url + prefix)
-	for item := range res.Data.Data {
-		list = append(list, item)
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return list, err
+		}
+		path, _ := k.(string)
+		sub, err := vs.listPath(ctx, listPath+prefix, loadPath+prefix, "/"+path)
+		list = append(list, sub...)
+		if err != nil {
+			return list, err
+		}
 	}
-	return list
+	return list, nil
 }
 
-// Lock locks operations on certificate with particular key
-func (vs *VaultStorage) Lock(c context.Context, key string) error {
-	key = key + ".lock"
-
-	if vs.Exists(c, key) {
-
-		if stat, err := vs.Stat(c, key); err == nil {
-
-			// check for deadlock, wait for 5 (300s) minutes
-			if time.Now().Unix()-stat.Modified.Unix() > 60 {
-				_ = vs.Unlock(c, key)
-			} else {
-				return errors.New("Lock already exists")
-			}
-		} else {
-			return err
-		}
+func (vs *VaultStorage) queryPath(ctx context.Context, url, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return lockSystem(key, vs.buildURL(dataURL, key))
+	rctx, cancel := vs.withTimeout(ctx)
+	defer cancel()
+	secret, err := vs.client.Logical().ReadWithContext(rctx, url+prefix)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	var list []string
+	for item := range secretData(secret) {
+		list = append(list, item)
+	}
+	return list, nil
 }
 
-// Unlock unlocks operations on certificate data
-func (vs *VaultStorage) Unlock(ctx context.Context, key string) error {
-	if strings.Index(key, ".lock") < 0 {
-		key = key + ".lock"
+// secretData returns the KV v2 "data" sub-object of secret, or nil.
+func secretData(secret *api.Secret) map[string]interface{} {
+	if secret == nil {
+		return nil
 	}
-	return vs.Delete(ctx, key)
+	data, _ := secret.Data["data"].(map[string]interface{})
+	return data
 }
 
-// Delete deletes the certificate from vault.
-func (vs *VaultStorage) Delete(ctx context.Context, key string) error {
-	response, err := utils.DeleteStore(vs.buildURL(metaURL, key))
-	if len(response.Errors) > 0 {
-		return errors.New("Failed to delete" + response.Errors[0])
+// secretDestroyed reports whether the KV v2 metadata of secret marks it destroyed.
+func secretDestroyed(secret *api.Secret) bool {
+	if secret == nil {
+		return false
 	}
-	return err
+	meta, _ := secret.Data["metadata"].(map[string]interface{})
+	destroyed, _ := meta["destroyed"].(bool)
+	return destroyed
 }
 
-func lockSystem(key, lockPath string) error {
-	data := make(map[string]string)
-	data[key] = "locked"
-	postBody := utils.Request{
-		Options: utils.Options{
-			Cas: 0,
-		},
-		Data: data,
+// secretCreatedTime parses the KV v2 metadata's created_time field of secret.
+func secretCreatedTime(secret *api.Secret) time.Time {
+	if secret == nil {
+		return time.Time{}
 	}
-	jsonData, _ := json.Marshal(postBody)
-	response, err := utils.LoadStore(lockPath, jsonData)
-	if len(response.Errors) > 0 {
-		return errors.New("Failed to lock: " + response.Errors[0])
-	}
-	return err
+	meta, _ := secret.Data["metadata"].(map[string]interface{})
+	created, _ := meta["created_time"].(string)
+	t, _ := time.Parse(time.RFC3339, created)
+	return t
 }
+
+// Lock and Unlock are implemented in lock.go.
@@ -0,0 +1,132 @@
+package caddyvault
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// testCaddyContext returns a caddy.Context suitable for calling Provision in tests.
+func testCaddyContext(t *testing.T) caddy.Context {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newTLSTestServer starts an httptest TLS server and writes its certificate's
+// PEM encoding to a temp file, returning the server and the CA cert path.
+func newTLSTestServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, string) {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	})
+	if err := os.WriteFile(caPath, pemBytes, 0o600); err != nil {
+		t.Fatalf("writing test CA file: %v", err)
+	}
+	return srv, caPath
+}
+
+func TestProvisionWithCACert(t *testing.T) {
+	srv, caPath := newTLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+	})
+
+	vs := &VaultStorage{
+		API: srv.URL,
+		TLS: TLSConfig{CACert: caPath},
+		Auth: AuthConfig{
+			Method: authMethodToken,
+			Token:  "test-token",
+		},
+	}
+
+	if err := vs.Provision(testCaddyContext(t)); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+
+	if vs.Exists(context.Background(), "missing-key") {
+		t.Fatalf("Exists() = true for a key that was never stored")
+	}
+}
+
+func TestProvisionRejectsUntrustedCert(t *testing.T) {
+	// The server reports the key as present, so Exists can only return false
+	// if the request never gets past the TLS handshake.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"data":{"some-key":"value"}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	vs := &VaultStorage{
+		API:  srv.URL,
+		Auth: AuthConfig{Method: authMethodToken, Token: "test-token"},
+	}
+	if err := vs.Provision(testCaddyContext(t)); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+
+	// Without the self-signed CA configured, requests must fail TLS verification.
+	if vs.Exists(context.Background(), "some-key") {
+		t.Fatalf("Exists() = true, expected the untrusted certificate to be rejected")
+	}
+}
+
+func TestUnmarshalCaddyfileAuth(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+		vault {
+			address http://127.0.0.1:8200
+			auth approle {
+				role_id    test-role-id
+				secret_id  test-secret-id
+				mount_path approle-prod
+			}
+		}
+	`)
+
+	var vs VaultStorage
+	if err := vs.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	if vs.Auth.Method != authMethodAppRole {
+		t.Errorf("Auth.Method = %q, want %q", vs.Auth.Method, authMethodAppRole)
+	}
+	if vs.Auth.RoleID != "test-role-id" {
+		t.Errorf("Auth.RoleID = %q, want %q", vs.Auth.RoleID, "test-role-id")
+	}
+	if vs.Auth.SecretID != "test-secret-id" {
+		t.Errorf("Auth.SecretID = %q, want %q", vs.Auth.SecretID, "test-secret-id")
+	}
+	if vs.Auth.MountPath != "approle-prod" {
+		t.Errorf("Auth.MountPath = %q, want %q", vs.Auth.MountPath, "approle-prod")
+	}
+}
+
+func TestUnmarshalCaddyfileAuthRejectsUnknownMethod(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+		vault {
+			address http://127.0.0.1:8200
+			auth bogus
+		}
+	`)
+
+	var vs VaultStorage
+	if err := vs.UnmarshalCaddyfile(d); err == nil {
+		t.Fatalf("UnmarshalCaddyfile() error = nil, want an error for an unrecognized auth method")
+	}
+}